@@ -0,0 +1,393 @@
+package digestauth
+
+import (
+	"context"
+	"crypto/subtle"
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum number of realms per host held by a challengeCache, beyond which the
+// least recently cached realm is evicted.
+const maxRealmsPerHost = 16
+
+// Maximum number of hosts that a challengeCache remembers as not having issued
+// a challenge, beyond which they are all forgotten.
+const maxUnchallengedHosts = 1024
+
+// A concurrency-safe cache of the most recent digest challenge issued for each
+// realm of each host.  A host may protect different paths with different
+// realms, so each challenge is cached along with the paths it covers (its
+// protection space): those listed by its "domain" directive, or else the
+// directory of the request that elicited it.  The cache also coordinates the
+// handshakes with hosts for which nothing is cached yet (see await).  All
+// methods are safe to call on a nil *challengeCache, in which case nothing is
+// cached.
+type challengeCache struct {
+	mutex      sync.RWMutex
+	challenges map[string][]challengeEntry
+
+	// For each host with a handshake in progress, a channel that is closed
+	// once the handshake is complete.
+	handshakes map[string]chan struct{}
+
+	// Hosts that answered a request without issuing a challenge, and haven't
+	// issued one since, for which handshakes aren't coordinated.
+	unchallenged map[string]bool
+}
+
+type challengeEntry struct {
+	challenge *Challenge
+
+	// Path prefixes of the protection space.
+	scopes []string
+}
+
+func newChallengeCache() *challengeCache {
+	return &challengeCache{
+		challenges:   make(map[string][]challengeEntry),
+		handshakes:   make(map[string]chan struct{}),
+		unchallenged: make(map[string]bool),
+	}
+}
+
+// Returns the cached challenge whose protection space best (i.e. most
+// specifically) covers the specified path on the specified host, preferring
+// the most recently cached one among equally specific ones.  If none covers
+// it, the host's most recently cached challenge is returned, or nil if
+// there is none.
+func (me *challengeCache) get(host, path string) *Challenge {
+	if me == nil {
+		return nil
+	}
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+	entries := me.challenges[host]
+	if len(entries) == 0 {
+		return nil
+	}
+
+	best, bestLength := entries[len(entries)-1].challenge, -1
+	for _, entry := range entries {
+		for _, scope := range entry.scopes {
+			if len(scope) >= bestLength && strings.HasPrefix(path, scope) {
+				best, bestLength = entry.challenge, len(scope)
+			}
+		}
+	}
+	return best
+}
+
+// Caches the provided challenge, which was issued by the specified host in
+// response to a request for the specified path, replacing any challenge
+// previously cached for the same realm.
+func (me *challengeCache) put(host, path string, challenge *Challenge) {
+	if me == nil {
+		return
+	}
+	entry := challengeEntry{challenge: challenge, scopes: challengeScopes(host, path, challenge.Domain)}
+
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	entries := removeRealm(me.challenges[host], challenge.Realm)
+	if len(entries) >= maxRealmsPerHost {
+		entries = entries[1:]
+	}
+	me.challenges[host] = append(entries, entry)
+	delete(me.unchallenged, host)
+}
+
+// Removes the challenge cached for the specified realm of the specified host.
+func (me *challengeCache) remove(host, realm string) {
+	if me == nil {
+		return
+	}
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if entries := removeRealm(me.challenges[host], realm); len(entries) > 0 {
+		me.challenges[host] = entries
+	} else {
+		delete(me.challenges, host)
+	}
+}
+
+// Removes all entries from the cache.
+func (me *challengeCache) clear() {
+	if me == nil {
+		return
+	}
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.challenges = make(map[string][]challengeEntry)
+	me.unchallenged = make(map[string]bool)
+}
+
+// Coordinates concurrent handshakes with the specified host, so that only one
+// of them elicits a challenge, which the others can then answer preemptively.
+// If no handshake with the host is in progress, one is registered on behalf of
+// the caller, and a function is returned that the caller must call once its
+// handshake is complete (whether or not it succeeded), reporting whether the
+// host turned out not to issue challenges.  Otherwise, await waits for the
+// handshake in progress to complete (or for ctx to be done, in which case ctx's
+// error is returned), and returns a nil function.  Requests to hosts known not
+// to issue challenges (e.g. public endpoints) aren't coordinated at all, so
+// await returns a function right away.
+func (me *challengeCache) await(ctx context.Context, host string) (func(unchallenged bool), error) {
+	if me == nil {
+		return func(bool) {}, nil
+	}
+	me.mutex.Lock()
+	if me.unchallenged[host] {
+		me.mutex.Unlock()
+		return func(bool) {}, nil
+	}
+	handshake, inProgress := me.handshakes[host]
+	if !inProgress {
+		handshake = make(chan struct{})
+		me.handshakes[host] = handshake
+	}
+	me.mutex.Unlock()
+
+	if !inProgress {
+		return func(unchallenged bool) {
+			me.mutex.Lock()
+			delete(me.handshakes, host)
+			if unchallenged && len(me.challenges[host]) == 0 {
+				if len(me.unchallenged) >= maxUnchallengedHosts {
+					me.unchallenged = make(map[string]bool)
+				}
+				me.unchallenged[host] = true
+			}
+			me.mutex.Unlock()
+			close(handshake)
+		}, nil
+	}
+	select {
+	case <-handshake:
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Returns a copy of entries without the entry for the specified realm.
+func removeRealm(entries []challengeEntry, realm string) []challengeEntry {
+	remaining := make([]challengeEntry, 0, len(entries)+1)
+	for _, entry := range entries {
+		if entry.challenge.Realm != realm {
+			remaining = append(remaining, entry)
+		}
+	}
+	return remaining
+}
+
+// Returns the path prefixes of the protection space of a challenge with the
+// provided "domain" directive (a space-separated list of URIs), which was
+// issued by the specified host in response to a request for the specified
+// path.  URIs of other hosts are ignored.  Without a "domain" directive, the
+// protection space is taken to be the directory of the requested path.
+func challengeScopes(host, path, domain string) []string {
+	var scopes []string
+	for _, uri := range strings.Fields(domain) {
+		u, err := url.Parse(uri)
+		if err != nil || (u.Host != "" && u.Host != host) {
+			continue
+		}
+		scope := u.Path
+		if scope == "" {
+			scope = "/"
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 && domain == "" {
+		scopes = append(scopes, path[:strings.LastIndex(path, "/")+1])
+	}
+	return scopes
+}
+
+// Maximum number of entries held by an ha1Cache before it is flushed.
+const maxHA1CacheEntries = 1024
+
+// A concurrency-safe cache of HA1 values (i.e. H(username:realm:password)),
+// which remain the same for as long as the credentials and realm are stable.
+// Each client has its own, which ClearCache empties.  Entries are keyed by
+// username, realm, and algorithm; the password is stored alongside the HA1 and
+// compared in constant time, so that a changed password is never served a
+// stale value.  (Hashing the password instead would cost as much as the HA1
+// calculation that the cache spares.)  All methods are safe to call on a nil
+// *ha1Cache, in which case nothing is cached.
+type ha1Cache struct {
+	mutex   sync.RWMutex
+	entries map[ha1CacheKey]ha1CacheEntry
+}
+
+type ha1CacheKey struct {
+	username  string
+	realm     string
+	algorithm string
+
+	// The generation of the algorithm registry (see RegisterAlgorithm), so
+	// that values computed by a replaced hash function are never served.
+	generation uint64
+}
+
+type ha1CacheEntry struct {
+	password string
+	ha1      string
+}
+
+func newHA1Cache() *ha1Cache {
+	return &ha1Cache{entries: make(map[ha1CacheKey]ha1CacheEntry)}
+}
+
+// Returns the cached HA1 for the provided inputs, calling calcHA1 to compute
+// (and cache) the value if it is not already cached.
+func (me *ha1Cache) get(username, realm, password, algorithm string, calcHA1 func() string) string {
+	if me == nil {
+		return calcHA1()
+	}
+	key := ha1CacheKey{username: username, realm: realm, algorithm: algorithm, generation: algorithmsGeneration()}
+
+	me.mutex.RLock()
+	entry, ok := me.entries[key]
+	me.mutex.RUnlock()
+	if ok && subtle.ConstantTimeCompare([]byte(entry.password), []byte(password)) == 1 {
+		return entry.ha1
+	}
+
+	ha1 := calcHA1()
+
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if len(me.entries) >= maxHA1CacheEntries {
+		me.entries = make(map[ha1CacheKey]ha1CacheEntry)
+	}
+	me.entries[key] = ha1CacheEntry{password: password, ha1: ha1}
+	return ha1
+}
+
+// Removes all entries from the cache.
+func (me *ha1Cache) clear() {
+	if me == nil {
+		return
+	}
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.entries = make(map[ha1CacheKey]ha1CacheEntry)
+}
+
+// Maximum number of sessions tracked by a sessionCache before it is flushed.
+const maxSessionCacheEntries = 1024
+
+// A concurrency-safe record of the digest session established with each realm
+// of each host (as with challengeCache, different hosts may well use the same
+// realm string, and even the same nonce).  A session lasts for as long as the
+// server keeps issuing the same nonce, and reuses the same client nonce
+// throughout (as required by the "-sess" algorithms), while the nonce count
+// increases with each request.  Nonce counts are kept with the session, unless
+// a NonceCounter is provided.  All methods are safe to call on a nil
+// *sessionCache, in which case every request starts a new session.
+type sessionCache struct {
+	mutex    sync.Mutex
+	sessions map[sessionKey]*session
+	counter  NonceCounter
+
+	// How long a session lasts before a new nonce is obtained (0 for as long
+	// as the server accepts it), as told by now.
+	ttl time.Duration
+	now func() time.Time
+}
+
+type sessionKey struct {
+	host  string
+	realm string
+}
+
+type session struct {
+	nonce   string
+	cnonce  []byte
+	nc      uint32
+	started time.Time
+}
+
+func newSessionCache() *sessionCache {
+	return &sessionCache{sessions: make(map[sessionKey]*session)}
+}
+
+// Advances the session with the specified realm of the specified host by one
+// request, and returns the raw client nonce and nonce count with which to
+// authorize the request.  A new session (with a new client nonce, and a count
+// of 1) is started if there is none yet, or if the server has since issued a
+// different nonce.  Once the session has used up all counts, a count of 0 is
+// returned, meaning that the server must issue a new nonce.
+func (me *sessionCache) next(host, realm, nonce string) (cnonce []byte, nc uint32) {
+	if me == nil {
+		return calcCnonce(), 1
+	}
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	key := sessionKey{host: host, realm: realm}
+	s, ok := me.sessions[key]
+	if !ok || s.nonce != nonce {
+		if len(me.sessions) >= maxSessionCacheEntries {
+			me.sessions = make(map[sessionKey]*session)
+		}
+		s = &session{nonce: nonce, cnonce: calcCnonce(), started: me.timeNow()}
+		me.sessions[key] = s
+	}
+	if me.counter != nil {
+		return s.cnonce, me.counter.Next(nonce)
+	}
+	if s.nc == math.MaxUint32 {
+		// The "nc" directive has 8 hex digits, so the count can't go on
+		// without wrapping around to a count the server has already seen.
+		return s.cnonce, 0
+	}
+	s.nc++
+	return s.cnonce, s.nc
+}
+
+// Reports whether the session with the specified realm of the specified host
+// has outlived the cache's TTL while using the specified nonce, in which case
+// the server should be made to issue a new one.  The session's lifetime
+// restarts, so that its count carries on if the server issues the same nonce
+// again.
+func (me *sessionCache) expire(host, realm, nonce string) bool {
+	if me == nil || me.ttl <= 0 {
+		return false
+	}
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	s, ok := me.sessions[sessionKey{host: host, realm: realm}]
+	if !ok || s.nonce != nonce {
+		return false
+	}
+	now := me.timeNow()
+	if now.Sub(s.started) < me.ttl {
+		return false
+	}
+	s.started = now
+	return true
+}
+
+// Returns the current time, as told by the cache's clock.
+func (me *sessionCache) timeNow() time.Time {
+	if me.now == nil {
+		return time.Now()
+	}
+	return me.now()
+}
+
+// Ends all sessions, so that the next request to each realm of each host starts
+// a new one.
+func (me *sessionCache) clear() {
+	if me == nil {
+		return
+	}
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.sessions = make(map[sessionKey]*session)
+}
@@ -0,0 +1,63 @@
+package digestauth
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// Default prefix of the environment variables read by EnvCredentials.
+const DefaultEnvPrefix = "DIGEST"
+
+// Returns a credential provider (see WithCredentialProvider) that looks up the
+// credentials for a host from environment variables, as is customary for
+// twelve-factor apps.  If prefix is "", DefaultEnvPrefix is used.
+//
+// The username and password are read from <prefix>_USERNAME and
+// <prefix>_PASSWORD, unless host-specific variables are set, whose names
+// insert the host (upper-cased, with every character other than letters and
+// digits replaced by '_') after the prefix.  For example, credentials for
+// "example.com:8080" are read from DIGEST_EXAMPLE_COM_8080_USERNAME and
+// DIGEST_EXAMPLE_COM_8080_PASSWORD, or else DIGEST_EXAMPLE_COM_USERNAME and
+// DIGEST_EXAMPLE_COM_PASSWORD, or else DIGEST_USERNAME and DIGEST_PASSWORD.
+// A pair of variables only counts if both are set.
+//
+// Unlike NetrcCredentials, the variables are read on every lookup, so changes
+// to the environment take effect right away.
+func EnvCredentials(prefix string) func(host string) (Credentials, bool) {
+	if prefix == "" {
+		prefix = DefaultEnvPrefix
+	}
+
+	return func(host string) (Credentials, bool) {
+		prefixes := []string{prefix + "_" + envHostKey(host)}
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			prefixes = append(prefixes, prefix+"_"+envHostKey(hostname))
+		}
+		prefixes = append(prefixes, prefix)
+
+		for _, prefix := range prefixes {
+			username, hasUsername := os.LookupEnv(prefix + "_USERNAME")
+			password, hasPassword := os.LookupEnv(prefix + "_PASSWORD")
+			if hasUsername && hasPassword {
+				return Credentials{Username: username, Password: password}, true
+			}
+		}
+		return Credentials{}, false
+	}
+}
+
+// Returns the provided host in the form used within environment variable
+// names, e.g. "EXAMPLE_COM_8080" for "example.com:8080".
+func envHostKey(host string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'):
+			return r
+		default:
+			return '_'
+		}
+	}, host)
+}
@@ -0,0 +1,123 @@
+package digestauth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// Sets the provided environment variables for the duration of a test, and
+// returns a function that restores their previous values.
+func setenv(vars map[string]string) func() {
+	type previous struct {
+		value string
+		set   bool
+	}
+	previousValues := make(map[string]previous)
+	for name, value := range vars {
+		oldValue, set := os.LookupEnv(name)
+		previousValues[name] = previous{oldValue, set}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, previous := range previousValues {
+			if previous.set {
+				os.Setenv(name, previous.value)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	defer setenv(map[string]string{
+		"DIGEST_USERNAME":                  "john",
+		"DIGEST_PASSWORD":                  "secret",
+		"DIGEST_EXAMPLE_ORG_USERNAME":      "jane",
+		"DIGEST_EXAMPLE_ORG_PASSWORD":      "other-secret",
+		"DIGEST_EXAMPLE_NET_8080_USERNAME": "mike",
+		"DIGEST_EXAMPLE_NET_8080_PASSWORD": "port-specific",
+		"DIGEST_EXAMPLE_EDU_USERNAME":      "incomplete",
+		"MY_APP_USERNAME":                  "custom",
+		"MY_APP_PASSWORD":                  "custom-secret",
+		"MY_APP_EXAMPLE_COM_USERNAME":      "custom-host",
+		"MY_APP_EXAMPLE_COM_PASSWORD":      "custom-host-secret",
+	})()
+
+	type TestCase struct {
+		Prefix        string
+		Host          string
+		ExpectedCreds Credentials
+	}
+
+	testCases := []TestCase{
+		TestCase{"", "example.com", Credentials{"john", "secret"}},
+		TestCase{"DIGEST", "example.com", Credentials{"john", "secret"}},
+		TestCase{"", "example.org", Credentials{"jane", "other-secret"}},
+		TestCase{"", "EXAMPLE.ORG", Credentials{"jane", "other-secret"}},
+		TestCase{"", "example.org:8080", Credentials{"jane", "other-secret"}}, // falls back to the hostname
+		TestCase{"", "example.net:8080", Credentials{"mike", "port-specific"}},
+		TestCase{"", "example.net", Credentials{"john", "secret"}},
+		TestCase{"", "example.edu", Credentials{"john", "secret"}}, // host-specific password missing
+		TestCase{"MY_APP", "example.com", Credentials{"custom-host", "custom-host-secret"}},
+		TestCase{"MY_APP", "example.org", Credentials{"custom", "custom-secret"}},
+	}
+
+	for i, testCase := range testCases {
+		creds, ok := EnvCredentials(testCase.Prefix)(testCase.Host)
+		assert.True(t, ok, fmt.Sprintf("Case %v failed", i))
+		assert.Equal(t, testCase.ExpectedCreds, creds, fmt.Sprintf("Case %v failed", i))
+	}
+
+	// Without any matching variables, there are no credentials
+	_, ok := EnvCredentials("NO_SUCH_PREFIX")("example.com")
+	assert.False(t, ok)
+}
+
+func TestEnvHostKey(t *testing.T) {
+	assert.Equal(t, "EXAMPLE_COM", envHostKey("example.com"))
+	assert.Equal(t, "EXAMPLE_COM_8080", envHostKey("Example.com:8080"))
+	assert.Equal(t, "___1__8080", envHostKey("[::1]:8080"))
+	assert.Equal(t, "MY_HOST", envHostKey("my-host"))
+}
+
+// Verifies that the environment variables drive the digest computation when
+// the URL has no credentials.
+func TestWithEnvCredentials(t *testing.T) {
+	defer setenv(map[string]string{
+		"TEST_DIGEST_USERNAME": "john",
+		"TEST_DIGEST_PASSWORD": "secret",
+	})()
+
+	server := httptest.NewServer(requireDigestAuth("my_realm", "john", "secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("some content"))
+	})))
+	defer server.Close()
+
+	client := NewDigestAuthClient(nil, WithEnvCredentials("TEST_DIGEST"))
+	body, statusCode, err := client.GetBytes(server.URL + "/some/resource")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "some content", string(body))
+
+	// The variables are read on every request
+	os.Setenv("TEST_DIGEST_PASSWORD", "wrong")
+	_, statusCode, err = client.GetBytes(server.URL + "/some/resource")
+	assert.True(t, errors.Is(err, ErrAuthenticationFailed))
+	assert.Equal(t, http.StatusUnauthorized, statusCode)
+
+	// URL credentials take precedence
+	_, statusCode, err = client.GetBytes(authURL(server, "john", "secret", "/some/resource"))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	// Without the variables, there are no credentials
+	os.Unsetenv("TEST_DIGEST_USERNAME")
+	_, _, err = client.GetBytes(server.URL + "/some/resource")
+	assert.True(t, errors.Is(err, ErrMissingCredentials))
+}
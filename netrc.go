@@ -0,0 +1,120 @@
+package digestauth
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Returns a credential provider (see WithCredentialProvider) that looks up the
+// credentials for a host from a .netrc file, as used by curl, ftp, git, and
+// many other command-line tools.  If path is "", the file named by the NETRC
+// environment variable is used, or ~/.netrc if that is not set.
+//
+// The file is read once, when this function is called.  A host matches a
+// 'machine' entry if the entry names either the host or the host sans port.
+// The 'default' entry, if any, matches all other hosts.
+func NetrcCredentials(path string) (func(host string) (Credentials, bool), error) {
+	if path == "" {
+		path = defaultNetrcPath()
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	machines, defaultCreds := parseNetrc(string(content))
+	return func(host string) (Credentials, bool) {
+		if creds, ok := machines[host]; ok {
+			return creds, true
+		}
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			if creds, ok := machines[hostname]; ok {
+				return creds, true
+			}
+		}
+		if defaultCreds != nil {
+			return *defaultCreds, true
+		}
+		return Credentials{}, false
+	}, nil
+}
+
+// Returns the path of the current user's .netrc file.
+func defaultNetrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".netrc")
+}
+
+// Parses the contents of a .netrc file into the credentials for each machine,
+// plus the credentials of the 'default' entry (nil if there is none).  If a
+// machine is listed more than once, its first entry wins.
+func parseNetrc(content string) (map[string]Credentials, *Credentials) {
+	type entry struct {
+		machine string
+		creds   *Credentials
+	}
+	var entries []entry
+	var defaultCreds *Credentials
+
+	// The credentials of the entry whose tokens are currently being parsed
+	var creds *Credentials
+
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		tokens := strings.Fields(lines[i])
+		for j := 0; j < len(tokens); j++ {
+			// Returns the token following the current one, if any.
+			next := func() string {
+				if j+1 >= len(tokens) {
+					return ""
+				}
+				j++
+				return tokens[j]
+			}
+
+			switch tokens[j] {
+			case "machine":
+				creds = &Credentials{}
+				entries = append(entries, entry{machine: next(), creds: creds})
+			case "default":
+				creds = &Credentials{}
+				defaultCreds = creds
+			case "login":
+				if creds != nil {
+					creds.Username = next()
+				}
+			case "password":
+				if creds != nil {
+					creds.Password = next()
+				}
+			case "account":
+				next()
+			case "macdef":
+				// A macro definition runs until the next blank line
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+				j = len(tokens)
+			default:
+				if strings.HasPrefix(tokens[j], "#") {
+					j = len(tokens) // the rest of the line is a comment
+				}
+			}
+		}
+	}
+
+	machines := make(map[string]Credentials)
+	for _, e := range entries {
+		if _, exists := machines[e.machine]; !exists {
+			machines[e.machine] = *e.creds
+		}
+	}
+	return machines, defaultCreds
+}
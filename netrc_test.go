@@ -0,0 +1,116 @@
+package digestauth
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testNetrc = `# Credentials for the test servers
+machine example.com login john password secret
+machine example.org
+    login jane
+    password other-secret # trailing comment
+machine example.com login duplicate password ignored
+
+macdef init
+machine not-a-real-entry login x password y
+
+machine example.net:8080 login mike account acme password port-specific
+`
+
+func TestNetrcCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".netrc")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(testNetrc), 0600))
+
+	provider, err := NetrcCredentials(path)
+	assert.Nil(t, err)
+
+	type TestCase struct {
+		Host          string
+		ExpectedCreds Credentials
+		ExpectedOk    bool
+	}
+
+	testCases := []TestCase{
+		TestCase{"example.com", Credentials{"john", "secret"}, true},
+		TestCase{"example.com:8443", Credentials{"john", "secret"}, true}, // port is ignored if no exact match
+		TestCase{"example.org", Credentials{"jane", "other-secret"}, true},
+		TestCase{"example.net:8080", Credentials{"mike", "port-specific"}, true},
+		TestCase{"example.net", Credentials{}, false},
+		TestCase{"not-a-real-entry", Credentials{}, false}, // part of a macro definition
+		TestCase{"unknown.com", Credentials{}, false},
+	}
+
+	for _, testCase := range testCases {
+		creds, ok := provider(testCase.Host)
+		assert.Equal(t, testCase.ExpectedOk, ok, testCase.Host)
+		assert.Equal(t, testCase.ExpectedCreds, creds, testCase.Host)
+	}
+}
+
+func TestNetrcCredentials_default(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".netrc")
+	netrc := "machine example.com login john password secret\ndefault login anonymous password guest\n"
+	assert.Nil(t, ioutil.WriteFile(path, []byte(netrc), 0600))
+
+	provider, err := NetrcCredentials(path)
+	assert.Nil(t, err)
+
+	creds, ok := provider("example.com")
+	assert.True(t, ok)
+	assert.Equal(t, Credentials{"john", "secret"}, creds)
+
+	creds, ok = provider("unknown.com")
+	assert.True(t, ok)
+	assert.Equal(t, Credentials{"anonymous", "guest"}, creds)
+}
+
+func TestNetrcCredentials_defaultPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "my-netrc")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("machine example.com login john password secret"), 0600))
+
+	origNetrc, hadNetrc := os.LookupEnv("NETRC")
+	os.Setenv("NETRC", path)
+	defer func() {
+		if hadNetrc {
+			os.Setenv("NETRC", origNetrc)
+		} else {
+			os.Unsetenv("NETRC")
+		}
+	}()
+
+	provider, err := NetrcCredentials("")
+	assert.Nil(t, err)
+	creds, ok := provider("example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "john", creds.Username)
+}
+
+func TestNetrcCredentials_missingFile(t *testing.T) {
+	_, err := NetrcCredentials(filepath.Join(t.TempDir(), "does-not-exist"))
+	assert.NotNil(t, err)
+}
+
+// Verifies that the netrc credentials drive the digest flow when the URL has
+// no credentials.
+func TestNetrcCredentials_withClient(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".netrc")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("machine example.com login john password secret"), 0600))
+	provider, err := NetrcCredentials(path)
+	assert.Nil(t, err)
+
+	server := &fakeDigestServer{nonce: "abc123"}
+	client := NewDigestAuthClient(server, WithCredentialProvider(provider))
+	response, err := client.Get("http://example.com/some/resource")
+	assert.Nil(t, err)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Contains(t, server.requests[1].Header.Get("Authorization"), `Digest username="john"`)
+
+	// A host without a netrc entry can't be authenticated
+	_, err = client.Get("http://example.org/some/resource")
+	assert.True(t, errors.Is(err, ErrMissingCredentials))
+}
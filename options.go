@@ -0,0 +1,454 @@
+package digestauth
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// An Option customizes the behavior of a DigestAuthClient.  Options are
+// provided to NewDigestAuthClient().
+type Option func(client *DigestAuthClient)
+
+// Enables or disables caching of digest challenges per host.  When enabled,
+// requests to a host that has already issued a challenge carry the
+// 'Authorization' header preemptively, saving the 'HTTP 401 UNAUTHORIZED'
+// round-trip.  Such requests continue the session established with the
+// challenge's realm (i.e. they reuse its nonce and client nonce, with an
+// incremented nonce count), and a new handshake is only performed once the
+// server rejects them.  A host that protects different paths with different
+// realms has a challenge cached for each realm, and requests answer the one
+// whose protection space (per its "domain" directive, or else the directory of
+// the request that elicited it) covers their path.  Concurrent requests to a
+// host for which nothing is cached yet don't each perform a handshake: one of
+// them does, while the others wait for it to complete and then answer the
+// challenge it obtained.  Once a host answers a request without a challenge
+// (e.g. a public endpoint), requests to it are no longer held up this way,
+// until it issues a challenge after all.  Caching is disabled by default.
+func WithChallengeCache(enabled bool) Option {
+	return func(client *DigestAuthClient) {
+		if enabled {
+			client.challenges = newChallengeCache()
+		} else {
+			client.challenges = nil
+		}
+	}
+}
+
+// Logger receives debugging output from a DigestAuthClient.  It is satisfied by
+// *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Sets a logger that receives debugging output about the digest handshake: the
+// parsed challenge, the computed HA1 (redacted) and HA2 values, the resulting
+// 'Authorization' header, and the outcome of the authorized retry.  Passwords
+// are never logged.  Logging is disabled by default.
+func WithLogger(logger Logger) Option {
+	return func(client *DigestAuthClient) {
+		client.logger = logger
+	}
+}
+
+// Writes a debugging message to logger, if it is not nil.
+func logf(logger Logger, format string, args ...interface{}) {
+	if logger != nil {
+		logger.Printf("digestauth: %v", fmt.Sprintf(format, args...))
+	}
+}
+
+// Redacts a sensitive value (such as HA1, which is as good as a password within
+// its realm) so that only a short prefix is logged.
+func redact(s string) string {
+	const visibleChars = 4
+	if len(s) <= visibleChars {
+		return "[redacted]"
+	}
+	return s[:visibleChars] + "...[redacted]"
+}
+
+// Forces the client to use the specified QOP directive (e.g. "auth") instead
+// of selecting one of the directives offered by the server.  This is useful
+// for interoperating with servers that misbehave unless a particular
+// directive is used.  An empty qop means the server's offer is used, which is
+// the default.  If the forced directive is not supported by this package,
+// requests fail with ErrUnsupportedQOP.
+func WithForcedQOP(qop string) Option {
+	return func(client *DigestAuthClient) {
+		client.forcedQop = qop
+	}
+}
+
+// Forces the client to use the specified algorithm (e.g. "SHA-256") instead
+// of the one advertised by the server.  The request proceeds even if the
+// server did not advertise the forced algorithm, since some servers accept
+// algorithms they don't advertise.  An empty algorithm means the server's
+// choice is used, which is the default.  If the forced algorithm is not
+// supported by this package, requests fail with ErrUnsupportedAlgorithm.
+func WithForcedAlgorithm(algorithm string) Option {
+	return func(client *DigestAuthClient) {
+		client.forcedAlgorithm = algorithm
+	}
+}
+
+// Limits how many bytes of a request body the client will buffer in memory in
+// order to replay the body on the authorized retry.  Bodies are only buffered
+// when request.GetBody is nil; requests with larger bodies fail with
+// ErrBodyTooLarge, in which case the caller should provide a GetBody function.
+// If n is not positive, DefaultMaxBodyBuffer is used.
+func WithMaxBodyBuffer(n int64) Option {
+	return func(client *DigestAuthClient) {
+		client.maxBodyBuffer = n
+	}
+}
+
+// Limits how many requests the client sends during a single exchange,
+// regardless of why they are needed: the initial request, a rejected
+// preemptive authorization (see WithChallengeCache), the authorized retry, and
+// any repetitions of the handshake due to redirects or stale nonces all count
+// towards the limit.  Once it is reached, the last 'HTTP 401 UNAUTHORIZED'
+// response is returned along with a MaxAttemptsError.  If n is not positive,
+// DefaultMaxAttempts is used.
+func WithMaxAttempts(n int) Option {
+	return func(client *DigestAuthClient) {
+		client.maxAttempts = n
+	}
+}
+
+// Enables or disables accepting credentials with an empty password, for
+// servers with password-less accounts.  When enabled, a URL that embeds just a
+// username (e.g. "http://john@example.com/") is answered on its behalf, with
+// the empty password hashed as is (i.e. HA1 = H(username:realm:)).  When
+// disabled, such credentials are treated as missing, so requests fail with
+// ErrMissingCredentials unless credentials are found elsewhere (see
+// WithCredentialProvider).  Empty passwords are disallowed by default.
+func WithAllowEmptyPassword(enabled bool) Option {
+	return func(client *DigestAuthClient) {
+		client.allowEmptyPassword = enabled
+	}
+}
+
+// Sets a function that supplies the credentials for requests whose URL does
+// not embed a username and password, given the request's host (e.g.
+// "example.com:8080").  The function returns false if it has no credentials
+// for the host, in which case requests fail with ErrMissingCredentials.
+// Credentials embedded in a URL always take precedence over the provider.
+// See NetrcCredentials for a provider backed by a .netrc file, and
+// WithEnvCredentials for one backed by environment variables.
+func WithCredentialProvider(provider func(host string) (Credentials, bool)) Option {
+	return func(client *DigestAuthClient) {
+		client.credentialProvider = provider
+	}
+}
+
+// Supplies the credentials for requests whose URL does not embed a username
+// and password from environment variables whose names start with the provided
+// prefix (e.g. DIGEST_USERNAME and DIGEST_PASSWORD for "DIGEST", the default
+// if prefix is ""), optionally specific to the request's host.  See
+// EnvCredentials for details.  This replaces any credential provider set via
+// WithCredentialProvider.
+func WithEnvCredentials(prefix string) Option {
+	return WithCredentialProvider(EnvCredentials(prefix))
+}
+
+// Sets headers (e.g. 'User-Agent' or 'Accept') that are added to every request
+// sent by the client, including the authorized retry.  A header that a request
+// already has is left as is, so per-request headers always take precedence.
+// The provided headers are copied, so later changes to them have no effect.
+func WithDefaultHeaders(headers http.Header) Option {
+	return func(client *DigestAuthClient) {
+		client.defaultHeaders = make(http.Header, len(headers))
+		for key, values := range headers {
+			client.defaultHeaders[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+		}
+	}
+}
+
+// Sets the 'User-Agent' header sent with every request made by the client,
+// including the authorized retry, regardless of the underlying http.Client.
+// A request that already has a 'User-Agent' header is left as is.  This takes
+// precedence over a 'User-Agent' provided via WithDefaultHeaders.
+func WithUserAgent(userAgent string) Option {
+	return func(client *DigestAuthClient) {
+		client.userAgent = userAgent
+	}
+}
+
+// Sets a function that is invoked with each request just before it is sent,
+// i.e. with both the initial request and the authorized retry (which carries
+// the 'Authorization' header).  This is useful for timing requests, starting
+// tracing spans, or logging.  The hook must not modify the request.
+func WithRequestHook(hook func(request *http.Request)) Option {
+	return func(client *DigestAuthClient) {
+		client.requestHook = hook
+	}
+}
+
+// Sets a function that is invoked with each response as soon as it is
+// received, i.e. with both the 'HTTP 401 UNAUTHORIZED' challenge and the
+// response to the authorized retry.  It is not invoked if a request fails
+// without a response.  The hook must not read or close the response's body.
+func WithResponseHook(hook func(response *http.Response)) Option {
+	return func(client *DigestAuthClient) {
+		client.responseHook = hook
+	}
+}
+
+// Sets the TLS configuration (e.g. custom root CAs or client certificates)
+// of the http.Client that NewDigestAuthClient creates when no Doer is
+// provided.  Its transport is otherwise the same as http.DefaultTransport.  The
+// option is ignored if a Doer is provided, which should be configured directly
+// instead.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(client *DigestAuthClient) {
+		client.tlsConfig = config
+	}
+}
+
+// Sets the cookie jar of the http.Client that NewDigestAuthClient creates when
+// no Doer is provided, for servers that issue session cookies alongside digest
+// authentication.  Cookies set by any response, including the 'HTTP 401
+// UNAUTHORIZED' challenge, are sent with the authorized retry and with
+// subsequent requests.  The option is ignored if a Doer is provided, which
+// should be configured directly instead.
+func WithCookieJar(jar http.CookieJar) Option {
+	return func(client *DigestAuthClient) {
+		client.cookieJar = jar
+	}
+}
+
+// Sets a time limit for each request made by the client.  The limit bounds the
+// entire exchange: the initial request, the authorized retry, and reading the
+// final response's body.  In other words, the retry does not restart the
+// clock.  Requests that exceed the limit fail with an error satisfying
+// errors.Is(err, context.DeadlineExceeded).  If d is not positive, which is the
+// default, no limit is imposed beyond that of the request's own context.
+func WithTimeout(d time.Duration) Option {
+	return func(client *DigestAuthClient) {
+		client.timeout = d
+	}
+}
+
+// Changes how the nonce count (the "nc" directive) is formatted, for the sake
+// of non-conformant servers.  The count is zero-padded to the specified width
+// (between 1 and 16 digits) in the specified base (10 or 16; hexadecimal
+// digits are lowercase).  A count needing more digits than width is never
+// truncated.  If either argument is invalid, the RFC's format is used, which is
+// also the default: 8 hexadecimal digits (e.g. "0000001a").
+func WithNonceCountFormat(width, base int) Option {
+	return func(client *DigestAuthClient) {
+		if width < 1 || width > 16 || (base != 10 && base != 16) {
+			client.ncFormat = nonceCountFormat{}
+			return
+		}
+		client.ncFormat = nonceCountFormat{width: width, base: base}
+	}
+}
+
+// NonceCounter issues the nonce counts (the "nc" directive) sent with each
+// server nonce.  The server rejects a count it has already seen for a nonce, so
+// clients sharing a nonce (e.g. the nodes of a cluster behind a sticky
+// session) must share a NonceCounter, which might be backed by Redis or
+// similar.
+type NonceCounter interface {
+	// Returns the next count for the specified server nonce: 1 for a nonce
+	// not seen before, and a count greater than any previously returned for
+	// the nonce otherwise.  Returns 0 once the counts for the nonce are
+	// exhausted, in which case the server is made to issue a new nonce.  Must
+	// be safe for concurrent use.
+	Next(nonce string) uint32
+}
+
+// Sets the NonceCounter that issues nonce counts.  By default, nonce counts
+// are kept in memory, alongside the client's other session state (see
+// WithChallengeCache).  A nil counter restores the default.
+func WithNonceCounter(counter NonceCounter) Option {
+	return func(client *DigestAuthClient) {
+		client.sessions = newSessionCache()
+		client.sessions.counter = counter
+	}
+}
+
+// Clock tells the time on behalf of a DigestAuthClient, e.g. when timing the
+// round trips reported via Stats, or when expiring sessions (see
+// WithSessionTTL).
+type Clock interface {
+	// Returns the current time.  Must be safe for concurrent use.
+	Now() time.Time
+}
+
+// Sets the Clock that the client uses to tell the time, which allows tests to
+// control it.  By default (or if clock is nil), the wall clock is used.  The
+// clock does not affect timeouts (see WithTimeout), which are enforced by the
+// request's context.
+func WithClock(clock Clock) Option {
+	return func(client *DigestAuthClient) {
+		client.clock = clock
+	}
+}
+
+// Sets how long the client keeps using a server nonce, as told by its clock
+// (see WithClock).  Once a nonce has been used for longer than ttl, the next
+// request is sent without authorization, so that the server issues a new
+// nonce (or reissues the same one, in which case its nonce count carries on).
+// If ttl is not positive, which is the default, a nonce is used for
+// as long as the server accepts it.
+func WithSessionTTL(ttl time.Duration) Option {
+	return func(client *DigestAuthClient) {
+		client.sessionTTL = ttl
+	}
+}
+
+// Sets a challenge previously issued by the specified host (e.g. the
+// Result.Challenge of an exchange made by an earlier process), for sending the
+// 'Authorization' header preemptively on the very first request to that host.
+// The host is matched against the request URL's host, including any port.  The
+// challenge is cached as if the host had just issued it (see
+// WithChallengeCache, which the option enables), so it is only answered for as
+// long as the host accepts it; once rejected, the regular handshake is
+// performed with the host's fresh challenge, which takes no more requests than
+// without the option.  The nonce must be one the host issued, since servers
+// reject nonces of the client's own making.  Requests to other hosts are
+// unaffected.  A nil challenge, which is the default, sets none.
+func WithDefaultChallenge(host string, challenge *Challenge) Option {
+	return func(client *DigestAuthClient) {
+		client.defaultHost, client.defaultChallenge = host, nil
+		if challenge != nil {
+			c := *challenge
+			client.defaultChallenge = &c
+		}
+	}
+}
+
+// Enables or disables the use of the absolute request URI (e.g.
+// "http://example.com/dir/index.html?a=b") as the "uri" directive, which is
+// also what HA2 is computed from, for servers (typically behind proxies) that
+// expect it.  By default, the "uri" directive holds the request-target as it
+// appears on the request line, i.e. the path and query (e.g.
+// "/dir/index.html?a=b").
+func WithAbsoluteURI(enabled bool) Option {
+	return func(client *DigestAuthClient) {
+		client.absoluteURI = enabled
+	}
+}
+
+// Sets whether the value of the specified directive (e.g. "qop") of the
+// 'Authorization' header is wrapped in double quotes, for servers that are
+// picky about it.  By default, as per RFC 7616, the "qop", "nc", "algorithm",
+// and "userhash" directives are sent unquoted, while all others are quoted.
+// The option can be provided repeatedly to set the policy of several
+// directives.  Note that a value containing separators (e.g. a realm with
+// spaces) must be quoted.  The "username*" directive is never quoted.
+func WithDirectiveQuoting(directive string, quoted bool) Option {
+	return func(client *DigestAuthClient) {
+		if client.quoting == nil {
+			client.quoting = make(map[string]bool)
+		}
+		client.quoting[strings.ToLower(directive)] = quoted
+	}
+}
+
+// CnonceEncoding selects how the random bytes of a client nonce are encoded in
+// the "cnonce" directive.
+type CnonceEncoding int
+
+const (
+	// Lowercase hexadecimal (e.g. "a3f1c9e0b2d47e15").  This is the default.
+	HexCnonce CnonceEncoding = iota
+
+	// Standard base64 (e.g. "o/HJ4LLUfhU="), for servers that expect an opaque
+	// base64 token.
+	Base64Cnonce
+)
+
+// Encodes the provided raw client nonce.
+func (me CnonceEncoding) encode(cnonce []byte) string {
+	if me == Base64Cnonce {
+		return base64.StdEncoding.EncodeToString(cnonce)
+	}
+	return hex.EncodeToString(cnonce)
+}
+
+// Selects how the client nonce is encoded (see CnonceEncoding).  Either
+// encoding is valid per the RFCs, but some servers only accept one of them.
+// The default is HexCnonce.
+func WithCnonceEncoding(encoding CnonceEncoding) Option {
+	return func(client *DigestAuthClient) {
+		client.cnonceEncoding = encoding
+	}
+}
+
+// Enables or disables automatically answering digest challenges.  When
+// disabled, a request that is challenged yields the server's 'HTTP 401
+// UNAUTHORIZED' response as is, and no second request is made; the parsed
+// challenge is available via DoWithResult() or GetWithResult().  This lets
+// callers drive the handshake themselves (see BuildAuthorization).  Automatic
+// retry is enabled by default.
+func WithAutoRetry(enabled bool) Option {
+	return func(client *DigestAuthClient) {
+		client.disableAutoRetry = !enabled
+	}
+}
+
+// Enables or disables falling back to Basic authentication.  When enabled, a
+// request that is challenged with only the Basic scheme (no Digest) is resent
+// with a Basic 'Authorization' header, provided credentials are available.
+// If the server offers both schemes, Digest is preferred, and Basic is only
+// used if the digest can't be calculated (e.g. due to an unsupported
+// algorithm) or Digest is disabled (see WithDigest).  Beware that Basic
+// authentication sends the password in the clear, so it should only be used
+// over HTTPS.  Fallback is disabled by default, in which case Basic challenges
+// are returned to the caller as is.
+func WithAllowBasicFallback(enabled bool) Option {
+	return func(client *DigestAuthClient) {
+		client.allowBasicFallback = enabled
+	}
+}
+
+// Enables or disables answering digest challenges.  When disabled, digest
+// challenges are ignored, so a server offering both schemes is answered with
+// Basic authentication (if fallback is enabled; see WithAllowBasicFallback),
+// and a server offering only Digest has its 'HTTP 401 UNAUTHORIZED' response
+// returned as is.  Digest is enabled by default.
+func WithDigest(enabled bool) Option {
+	return func(client *DigestAuthClient) {
+		client.disableDigest = !enabled
+	}
+}
+
+// Spec selects the RFC whose formatting conventions are followed when building
+// the 'Authorization' header.  The digest calculation itself is the same under
+// both; only the following directives differ:
+//
+//   - algorithm: under RFC2617 it is only sent if the server's challenge
+//     specified an algorithm (or one was forced via WithForcedAlgorithm).
+//     Under RFC7616 it is always sent, defaulting to "MD5".
+//   - userhash: never sent under RFC2617.  Under RFC7616 "userhash=false" is
+//     sent, since this package does not hash usernames.
+//
+// Under both, the qop, nc, algorithm, and userhash values are unquoted while
+// all other values are quoted.
+type Spec int
+
+const (
+	// RFC 2617 (https://tools.ietf.org/html/rfc2617) conventions.  This is
+	// the default, and works best with legacy servers.
+	RFC2617 Spec = iota
+
+	// RFC 7616 (https://tools.ietf.org/html/rfc7616) conventions, for modern
+	// servers.
+	RFC7616
+)
+
+// Selects the RFC whose formatting conventions are followed when building the
+// 'Authorization' header (see Spec).  The default is RFC2617.
+func WithSpec(spec Spec) Option {
+	return func(client *DigestAuthClient) {
+		client.spec = spec
+	}
+}